@@ -0,0 +1,277 @@
+// Package addrmap derives overlay addresses for libp2p peers and keeps the
+// peer<->address mapping reversible and collision-free across a single
+// overlay. It replaces the old stateless XOR fold, which happily handed out
+// the same 4-byte NetID to two different peers and left no way to go from an
+// address back to a peer.
+package addrmap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ErrCollision is returned by Allocate when the derived NetID already
+// belongs to a different peer on this overlay.
+var ErrCollision = errors.New("addrmap: NetID collision with an existing peer")
+
+// ErrNotFound is returned by Resolve when no peer maps to the given address.
+var ErrNotFound = errors.New("addrmap: no peer known for address")
+
+// Family selects which address space an overlay hands out host suffixes
+// from.
+type Family int
+
+const (
+	// FamilyIPv6ULA derives addresses under the "\xfd\x00hyprspace" ULA
+	// prefix (fd00:6879:7072:7370:6163:6500::/96), the scheme the original
+	// mkBuiltinAddr6 used.
+	FamilyIPv6ULA Family = iota
+	// FamilyIPv4CGNAT derives addresses under the 100.64.0.0/10 CGNAT
+	// range, for overlays that need to interoperate with IPv4-only peers.
+	FamilyIPv4CGNAT
+)
+
+var (
+	ula6Prefix  = net.ParseIP("fd00:6879:7072:7370:6163:6500::")
+	cgnatPrefix = net.ParseIP("100.64.0.0")
+	cgnatMask   = net.CIDRMask(10, 32)
+)
+
+// ParseFamily parses the --family flag value shared by the hyprspace CLIs.
+func ParseFamily(s string) (Family, error) {
+	switch s {
+	case "", "ula6", "ipv6":
+		return FamilyIPv6ULA, nil
+	case "cgnat", "ipv4":
+		return FamilyIPv4CGNAT, nil
+	default:
+		return 0, fmt.Errorf("addrmap: unknown family %q (want ula6 or cgnat)", s)
+	}
+}
+
+// Map is a persistent, reversible peer<->address table for one overlay. A
+// Map is safe for concurrent use.
+type Map struct {
+	path   string
+	family Family
+
+	mu        sync.Mutex
+	peerToIP  map[peer.ID]net.IP
+	ipToPeers map[string][]peer.ID // NetID collisions land here pre-check
+}
+
+// record is the on-disk representation of a Map.
+type record struct {
+	Family   Family            `json:"family"`
+	PeerToIP map[string]string `json:"peer_to_ip"`
+}
+
+// Open loads the Map persisted at path, creating an empty one if the file
+// does not exist yet.
+func Open(path string, family Family) (*Map, error) {
+	m := &Map{
+		path:      path,
+		family:    family,
+		peerToIP:  make(map[peer.ID]net.IP),
+		ipToPeers: make(map[string][]peer.ID),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("addrmap: reading %s: %w", path, err)
+	}
+
+	var rec record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("addrmap: decoding %s: %w", path, err)
+	}
+	m.family = rec.Family
+	for idStr, ipStr := range rec.PeerToIP {
+		id, err := peer.Decode(idStr)
+		if err != nil {
+			return nil, fmt.Errorf("addrmap: decoding peer id %q: %w", idStr, err)
+		}
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return nil, fmt.Errorf("addrmap: decoding address %q for %s", ipStr, idStr)
+		}
+		m.peerToIP[id] = ip
+		m.ipToPeers[ip.String()] = append(m.ipToPeers[ip.String()], id)
+	}
+	return m, nil
+}
+
+// Allocate returns the address assigned to p, deriving and persisting a new
+// one if this is the first time p has been seen on this overlay. It returns
+// ErrCollision if the derived NetID already belongs to a different peer.
+// Allocate only has p's peer.ID to work with, so it can only recover the
+// public key DeriveAddr needs for peers whose ID embeds it (e.g. Ed25519);
+// callers that already hold the peer's crypto.PubKey — a peerstore's
+// KeyBook, say — should call AllocatePubKey instead, which works for every
+// key type addrmap supports, RSA and secp256k1 included.
+func (m *Map) Allocate(p peer.ID) (net.IP, error) {
+	return m.allocate(p, nil)
+}
+
+// AllocatePubKey is Allocate for a caller that already knows p's public key.
+func (m *Map) AllocatePubKey(p peer.ID, pub crypto.PubKey) (net.IP, error) {
+	return m.allocate(p, pub)
+}
+
+func (m *Map) allocate(p peer.ID, pub crypto.PubKey) (net.IP, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ip, ok := m.peerToIP[p]; ok {
+		return ip, nil
+	}
+
+	prefix := ula6Prefix
+	if m.family == FamilyIPv4CGNAT {
+		prefix = cgnatPrefix
+	}
+
+	var ip net.IP
+	var err error
+	if pub != nil {
+		ip, err = DeriveAddr(pub, prefix)
+	} else {
+		ip, err = deriveFromPeerID(p, prefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if existing := m.ipToPeers[ip.String()]; len(existing) > 0 && existing[0] != p {
+		return nil, fmt.Errorf("%w: %s and %s both derive %s", ErrCollision, existing[0], p, ip)
+	}
+
+	m.peerToIP[p] = ip
+	m.ipToPeers[ip.String()] = append(m.ipToPeers[ip.String()], p)
+	if err := m.save(); err != nil {
+		return nil, err
+	}
+	return ip, nil
+}
+
+// Resolve returns the peer ID that owns ip, or ErrNotFound if none is known.
+// When a collision was force-allocated (see MigrateLegacy) it returns the
+// first peer that claimed the address in this Map. That order is not
+// persisted: after Open or Reload, which of the colliding peers comes first
+// is not defined.
+func (m *Map) Resolve(ip net.IP) (peer.ID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peers, ok := m.ipToPeers[ip.String()]
+	if !ok || len(peers) == 0 {
+		return "", ErrNotFound
+	}
+	return peers[0], nil
+}
+
+// Peers returns every peer ID this Map has allocated an address for. Callers
+// that don't otherwise have a live view of the overlay's membership (e.g.
+// hyprspace-resolverd) can use this to bootstrap a peer list straight from
+// the persisted state addrmap already maintains.
+func (m *Map) Peers() []peer.ID {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := make([]peer.ID, 0, len(m.peerToIP))
+	for p := range m.peerToIP {
+		ids = append(ids, p)
+	}
+	return ids
+}
+
+// Reload re-reads the state file from disk, picking up peers that another
+// process (e.g. the hyprspace-addr CLI) has allocated addresses for since
+// this Map was opened. It leaves the in-memory state untouched if the file
+// can't be read or decoded, so a transient disk error doesn't drop peers
+// that were already known.
+func (m *Map) Reload() error {
+	fresh, err := Open(m.path, m.family)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peerToIP = fresh.peerToIP
+	m.ipToPeers = fresh.ipToPeers
+	return nil
+}
+
+// Candidates returns every peer ID that has ever mapped to ip, which is only
+// ever more than one entry for NetIDs derived before collision detection
+// existed (see MigrateLegacy).
+func (m *Map) Candidates(ip net.IP) []peer.ID {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]peer.ID(nil), m.ipToPeers[ip.String()]...)
+}
+
+// MigrateLegacy imports peer IDs that were addressed under the old
+// deterministic-only XOR-fold scheme (mkBuiltinAddr6) without rejecting
+// collisions, so an overlay can be brought under collision detection
+// without breaking peers that are already using their legacy address. Any
+// collision found is recorded in ipToPeers but does not error; Resolve
+// returns the first registrant until the Map is reopened (see Resolve), and
+// callers should re-key colliding peers out of band.
+func (m *Map) MigrateLegacy(ids []peer.ID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range ids {
+		if _, ok := m.peerToIP[p]; ok {
+			continue
+		}
+		prefix := ula6Prefix
+		if m.family == FamilyIPv4CGNAT {
+			prefix = cgnatPrefix
+		}
+		ip := applyHostBits(legacyNetID(p), prefix)
+		m.peerToIP[p] = ip
+		m.ipToPeers[ip.String()] = append(m.ipToPeers[ip.String()], p)
+	}
+	return m.save()
+}
+
+func (m *Map) save() error {
+	rec := record{
+		Family:   m.family,
+		PeerToIP: make(map[string]string, len(m.peerToIP)),
+	}
+	for p, ip := range m.peerToIP {
+		rec.PeerToIP[p.String()] = ip.String()
+	}
+	data, err := json.MarshalIndent(&rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("addrmap: encoding %s: %w", m.path, err)
+	}
+	if err := os.WriteFile(m.path, data, 0o600); err != nil {
+		return fmt.Errorf("addrmap: writing %s: %w", m.path, err)
+	}
+	return nil
+}
+
+func cgnatHostBits(netID [4]byte) net.IP {
+	ip4 := make(net.IP, net.IPv4len)
+	copy(ip4, cgnatPrefix.To4())
+	// Only the bits outside the /10 mask are ours to set.
+	for i := range ip4 {
+		ip4[i] &= cgnatMask[i]
+		ip4[i] |= netID[i] &^ cgnatMask[i]
+	}
+	return ip4
+}
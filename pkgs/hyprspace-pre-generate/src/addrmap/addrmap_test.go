@@ -0,0 +1,207 @@
+package addrmap
+
+import (
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/crypto/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestCgnatHostBits(t *testing.T) {
+	ip := cgnatHostBits([4]byte{0xff, 0xff, 0xff, 0xff})
+	if ip[0] != 100 {
+		t.Fatalf("cgnatHostBits should stay under 100.0.0.0, got %s", ip)
+	}
+	if ip[1] < 64 || ip[1] > 127 {
+		t.Errorf("cgnatHostBits escaped the /10 mask: %s", ip)
+	}
+}
+
+func TestApplyHostBitsULA(t *testing.T) {
+	ip := applyHostBits([4]byte{1, 2, 3, 4}, ula6Prefix)
+	for i, want := range []byte{1, 2, 3, 4} {
+		if ip[12+i] != want {
+			t.Errorf("applyHostBits wrote %x at host byte %d, want %x", ip[12+i], i, want)
+		}
+	}
+	if !ip[:12].Equal(ula6Prefix.To16()[:12]) {
+		t.Errorf("applyHostBits touched the network prefix: got %s", ip)
+	}
+}
+
+// genPeerID returns a fresh, valid peer.ID backed by a real Ed25519 key.
+func genPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating ed25519 key: %v", err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatalf("peer.IDFromPublicKey: %v", err)
+	}
+	return id
+}
+
+func newTestMap(t *testing.T) *Map {
+	t.Helper()
+	m, err := Open(filepath.Join(t.TempDir(), "state.json"), FamilyIPv6ULA)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return m
+}
+
+func TestAllocateIsIdempotent(t *testing.T) {
+	m := newTestMap(t)
+	p := genPeerID(t)
+
+	ip1, err := m.Allocate(p)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	ip2, err := m.Allocate(p)
+	if err != nil {
+		t.Fatalf("Allocate (2nd call): %v", err)
+	}
+	if !ip1.Equal(ip2) {
+		t.Errorf("Allocate returned different addresses for the same peer: %s != %s", ip1, ip2)
+	}
+}
+
+func TestAllocatePubKeyCollision(t *testing.T) {
+	m := newTestMap(t)
+	p1, p2 := genPeerID(t), genPeerID(t)
+
+	// Give both peers the same fake public key so they're guaranteed to
+	// derive the same NetID, simulating a real collision without relying
+	// on two independently-generated keys happening to clash.
+	shared := fakePubKey{typ: pb.KeyType_Ed25519, raw: []byte{0x13, 0x37, 0x42, 0x99}}
+
+	if _, err := m.AllocatePubKey(p1, shared); err != nil {
+		t.Fatalf("AllocatePubKey(p1): %v", err)
+	}
+	if _, err := m.AllocatePubKey(p2, shared); !errors.Is(err, ErrCollision) {
+		t.Fatalf("AllocatePubKey(p2) with a colliding key: got err %v, want ErrCollision", err)
+	}
+
+	// p2 must not have been persisted as a result of the failed allocation.
+	if _, ok := m.peerToIP[p2]; ok {
+		t.Error("a colliding Allocate should not record the losing peer")
+	}
+}
+
+func TestResolveNotFound(t *testing.T) {
+	m := newTestMap(t)
+	if _, err := m.Resolve(ula6Prefix); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Resolve on an empty map: got err %v, want ErrNotFound", err)
+	}
+}
+
+func TestOpenPersistsAcrossReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	m, err := Open(path, FamilyIPv6ULA)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	p := genPeerID(t)
+	ip, err := m.Allocate(p)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+
+	reopened, err := Open(path, FamilyIPv6ULA)
+	if err != nil {
+		t.Fatalf("Open (reload): %v", err)
+	}
+	got, err := reopened.Resolve(ip)
+	if err != nil {
+		t.Fatalf("Resolve after reopening: %v", err)
+	}
+	if got != p {
+		t.Errorf("Resolve after reopening returned %s, want %s", got, p)
+	}
+}
+
+func TestMapReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	writer, err := Open(path, FamilyIPv6ULA)
+	if err != nil {
+		t.Fatalf("Open (writer): %v", err)
+	}
+	reader, err := Open(path, FamilyIPv6ULA)
+	if err != nil {
+		t.Fatalf("Open (reader): %v", err)
+	}
+
+	p := genPeerID(t)
+	ip, err := writer.Allocate(p)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+
+	if _, err := reader.Resolve(ip); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("reader should not see writer's allocation before Reload")
+	}
+	if err := reader.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	got, err := reader.Resolve(ip)
+	if err != nil {
+		t.Fatalf("Resolve after Reload: %v", err)
+	}
+	if got != p {
+		t.Errorf("Resolve after Reload returned %s, want %s", got, p)
+	}
+}
+
+func TestMapPeers(t *testing.T) {
+	m := newTestMap(t)
+	p1, p2 := genPeerID(t), genPeerID(t)
+	if _, err := m.Allocate(p1); err != nil {
+		t.Fatalf("Allocate(p1): %v", err)
+	}
+	if _, err := m.Allocate(p2); err != nil {
+		t.Fatalf("Allocate(p2): %v", err)
+	}
+
+	peers := m.Peers()
+	if len(peers) != 2 {
+		t.Fatalf("Peers() returned %d peers, want 2", len(peers))
+	}
+	seen := map[peer.ID]bool{peers[0]: true, peers[1]: true}
+	if !seen[p1] || !seen[p2] {
+		t.Errorf("Peers() = %v, want to contain %s and %s", peers, p1, p2)
+	}
+}
+
+func TestParseFamily(t *testing.T) {
+	cases := map[string]Family{
+		"":      FamilyIPv6ULA,
+		"ula6":  FamilyIPv6ULA,
+		"ipv6":  FamilyIPv6ULA,
+		"cgnat": FamilyIPv4CGNAT,
+		"ipv4":  FamilyIPv4CGNAT,
+	}
+	for in, want := range cases {
+		got, err := ParseFamily(in)
+		if err != nil {
+			t.Errorf("ParseFamily(%q): %v", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("ParseFamily(%q) = %v, want %v", in, got, want)
+		}
+	}
+	if _, err := ParseFamily("bogus"); err == nil {
+		t.Error(`ParseFamily("bogus") should error`)
+	}
+}
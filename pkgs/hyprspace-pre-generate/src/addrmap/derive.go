@@ -0,0 +1,88 @@
+package addrmap
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/crypto/blake2b"
+)
+
+// ErrUnsupportedKeyType is returned by DeriveAddr for a crypto.PubKey whose
+// KeyType this package does not yet know how to fold into an address.
+var ErrUnsupportedKeyType = fmt.Errorf("addrmap: unsupported key type")
+
+// fold reduces an arbitrary-length hash down to the 4-byte host suffix by
+// XORing it in 4-byte groups, the same reduction the original XOR-fold used.
+func fold(hash []byte) [4]byte {
+	r := [4]byte{0xde, 0xad, 0xbe, 0xef}
+	for i, b := range hash {
+		r[i%4] ^= b
+	}
+	return r
+}
+
+// netIDFromPubKey hashes pub's raw key bytes with BLAKE2b-128 and folds the
+// result into a 4-byte NetID. Unlike folding the peer.ID directly, this
+// works the same way regardless of key size: peer.ID is a multihash of the
+// public key (raw bytes for small "identity"-hashed keys, a SHA-256 digest
+// for larger ones like RSA), so folding it mixes in multihash prefix and
+// digest-algorithm bytes that carry no key entropy at all.
+func netIDFromPubKey(pub crypto.PubKey) ([4]byte, error) {
+	switch pub.Type() {
+	case crypto.Ed25519, crypto.RSA, crypto.Secp256k1, crypto.ECDSA:
+	default:
+		return [4]byte{}, fmt.Errorf("%w: %v", ErrUnsupportedKeyType, pub.Type())
+	}
+
+	raw, err := pub.Raw()
+	if err != nil {
+		return [4]byte{}, fmt.Errorf("addrmap: reading raw public key: %w", err)
+	}
+	sum, err := blake2b.New(16, nil)
+	if err != nil {
+		return [4]byte{}, fmt.Errorf("addrmap: blake2b-128: %w", err)
+	}
+	sum.Write(raw)
+	return fold(sum.Sum(nil)), nil
+}
+
+// DeriveAddr computes the overlay address for pub by BLAKE2b-128 hashing its
+// raw key bytes and folding the digest into prefix's host bits. prefix must
+// be either the IPv6 ULA prefix or the IPv4 CGNAT base address. Under the
+// ULA prefix the last 4 bytes are replaced; under CGNAT only the 22 bits
+// outside the /10 mask are, so the 10 high bits of the NetID are dropped.
+// Everything else is left untouched. It returns
+// ErrUnsupportedKeyType for key types it doesn't know how to hash.
+func DeriveAddr(pub crypto.PubKey, prefix net.IP) (net.IP, error) {
+	id, err := netIDFromPubKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return applyHostBits(id, prefix), nil
+}
+
+// deriveFromPeerID is the fallback used when only a peer.ID is available
+// (the CLI's batch/plain-peer-id paths). It recovers the embedded public key
+// where possible; peer IDs minted from large keys (e.g. RSA) hash the
+// public key into the ID itself and cannot be reversed, so for those it
+// returns ExtractPublicKey's error, wrapped; that error is not
+// ErrUnsupportedKeyType.
+func deriveFromPeerID(p peer.ID, prefix net.IP) (net.IP, error) {
+	pub, err := p.ExtractPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("addrmap: cannot recover public key from %s: %w", p, err)
+	}
+	return DeriveAddr(pub, prefix)
+}
+
+func applyHostBits(id [4]byte, prefix net.IP) net.IP {
+	if prefix.Equal(cgnatPrefix) {
+		return cgnatHostBits(id)
+	}
+	addr := make(net.IP, net.IPv6len)
+	copy(addr, prefix.To16())
+	addr[12], addr[13], addr[14], addr[15] = id[0], id[1], id[2], id[3]
+	return addr
+}
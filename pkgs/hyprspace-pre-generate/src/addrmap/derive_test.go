@@ -0,0 +1,134 @@
+package addrmap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/crypto/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestFold(t *testing.T) {
+	got := fold([]byte{0x00, 0x00, 0x00, 0x00})
+	want := [4]byte{0xde, 0xad, 0xbe, 0xef}
+	if got != want {
+		t.Errorf("fold of all-zero input should be the untouched seed, got %x want %x", got, want)
+	}
+
+	got = fold([]byte{0xff, 0xff, 0xff, 0xff})
+	want = [4]byte{0xde ^ 0xff, 0xad ^ 0xff, 0xbe ^ 0xff, 0xef ^ 0xff}
+	if got != want {
+		t.Errorf("fold(0xff*4) = %x, want %x", got, want)
+	}
+
+	// Longer input keeps folding in 4-byte groups rather than truncating.
+	got = fold([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	want = [4]byte{0xde ^ 1 ^ 5, 0xad ^ 2 ^ 6, 0xbe ^ 3 ^ 7, 0xef ^ 4 ^ 8}
+	if got != want {
+		t.Errorf("fold(8 bytes) = %x, want %x", got, want)
+	}
+}
+
+func TestDeriveAddrEd25519(t *testing.T) {
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating ed25519 key: %v", err)
+	}
+
+	ip, err := DeriveAddr(pub, ula6Prefix)
+	if err != nil {
+		t.Fatalf("DeriveAddr: %v", err)
+	}
+	if !bytes.Equal(ip[:12], ula6Prefix.To16()[:12]) {
+		t.Errorf("DeriveAddr should leave the ULA prefix untouched, got %s", ip)
+	}
+
+	// Deriving again for the same key must be deterministic.
+	ip2, err := DeriveAddr(pub, ula6Prefix)
+	if err != nil {
+		t.Fatalf("DeriveAddr (2nd call): %v", err)
+	}
+	if !ip.Equal(ip2) {
+		t.Errorf("DeriveAddr is not deterministic: %s != %s", ip, ip2)
+	}
+}
+
+func TestDeriveAddrCGNAT(t *testing.T) {
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating ed25519 key: %v", err)
+	}
+
+	ip, err := DeriveAddr(pub, cgnatPrefix)
+	if err != nil {
+		t.Fatalf("DeriveAddr: %v", err)
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		t.Fatalf("DeriveAddr with the CGNAT prefix should return an IPv4 address, got %s", ip)
+	}
+	if ip4[0] != 100 || ip4[1] < 64 || ip4[1] > 127 {
+		t.Errorf("derived address %s is outside 100.64.0.0/10", ip)
+	}
+}
+
+func TestDeriveAddrUnsupportedKeyType(t *testing.T) {
+	_, err := DeriveAddr(fakePubKey{typ: 99}, ula6Prefix)
+	if !errors.Is(err, ErrUnsupportedKeyType) {
+		t.Fatalf("DeriveAddr with an unknown key type: got err %v, want ErrUnsupportedKeyType", err)
+	}
+}
+
+func TestDeriveFromPeerIDRejectsLargeKeys(t *testing.T) {
+	// RSA peer IDs are a SHA-256 digest of the public key, not the key
+	// itself, so ExtractPublicKey can never recover it and
+	// deriveFromPeerID must fail rather than silently fold the hash.
+	priv, _, err := crypto.GenerateRSAKeyPair(2048, rand.Reader)
+	if err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("peer.IDFromPrivateKey: %v", err)
+	}
+
+	if _, err := deriveFromPeerID(id, ula6Prefix); err == nil {
+		t.Fatalf("deriveFromPeerID should fail for an RSA peer ID, got a result instead")
+	}
+}
+
+func TestDeriveAddrRSAFromPubKey(t *testing.T) {
+	// Unlike deriveFromPeerID, DeriveAddr doesn't need to recover the key
+	// from the peer.ID, so it must work for RSA when the caller already
+	// has the key (e.g. from a peerstore's KeyBook).
+	_, pub, err := crypto.GenerateRSAKeyPair(2048, rand.Reader)
+	if err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+	if _, err := DeriveAddr(pub, ula6Prefix); err != nil {
+		t.Errorf("DeriveAddr should support RSA keys, got: %v", err)
+	}
+}
+
+// fakePubKey lets tests exercise netIDFromPubKey's default case, and force
+// deterministic NetID collisions, without depending on real key generation
+// happening to produce colliding hashes.
+type fakePubKey struct {
+	typ pb.KeyType
+	raw []byte
+}
+
+func (k fakePubKey) Equals(crypto.Key) bool { return false }
+func (k fakePubKey) Raw() ([]byte, error) {
+	if k.raw != nil {
+		return k.raw, nil
+	}
+	return []byte{1, 2, 3}, nil
+}
+func (k fakePubKey) Type() pb.KeyType                    { return k.typ }
+func (k fakePubKey) Verify([]byte, []byte) (bool, error) { return false, nil }
+
+var _ crypto.PubKey = fakePubKey{}
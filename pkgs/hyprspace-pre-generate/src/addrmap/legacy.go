@@ -0,0 +1,15 @@
+package addrmap
+
+import "github.com/libp2p/go-libp2p/core/peer"
+
+// legacyNetID reproduces the original mkBuiltinAddr6/MkNetID fold over the
+// raw peer.ID bytes. It exists only so MigrateLegacy can reconstruct the
+// addresses peers were already handed out under before DeriveAddr moved to
+// hashing the actual public key; new allocations never use it.
+func legacyNetID(p peer.ID) [4]byte {
+	r := [4]byte{0xde, 0xad, 0xbe, 0xef}
+	for i, b := range []byte(p) {
+		r[i%4] ^= b
+	}
+	return r
+}
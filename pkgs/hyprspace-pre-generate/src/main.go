@@ -1,46 +1,209 @@
+// Command hyprspace-addr derives the overlay address hyprspace assigns a
+// libp2p peer. It accepts bare peer IDs, `/p2p/<id>` multiaddrs, or fully
+// encapsulated multiaddrs such as `/ip4/1.2.3.4/tcp/4001/p2p/<id>`, and can
+// batch-process a list of them from stdin.
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"net"
-	"flag"
 	"os"
+	"strings"
+
+	ma "github.com/multiformats/go-multiaddr"
 	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/Qubasa/vpn-bench/pkgs/hyprspace-pre-generate/src/addrmap"
 )
 
-func MkNetID(decoded_peerid peer.ID) [4]byte {
-	r := [4]byte{0xde, 0xad, 0xbe, 0xef}
-	for i, b := range []byte(decoded_peerid) {
-		r[i%4] ^= b
+// outputFormat controls how a resolved peer/address pair is printed.
+type outputFormat string
+
+const (
+	formatPlain     outputFormat = "plain"
+	formatJSON      outputFormat = "json"
+	formatMultiaddr outputFormat = "multiaddr"
+)
+
+func main() {
+	peerFlag := flag.String("peer", "", "peer id, /p2p multiaddr, or encapsulated multiaddr")
+	format := flag.String("format", "plain", "output format: plain, json, or multiaddr")
+	reverse := flag.String("reverse", "", "list known peer IDs whose derived address matches this IPv6")
+	statePath := flag.String("state", "hyprspace-addr.json", "path to the persistent peer<->address map")
+	familyFlag := flag.String("family", "ula6", "address family to derive: ula6 (IPv6 ULA) or cgnat (IPv4 100.64.0.0/10)")
+	migrateLegacy := flag.String("migrate-legacy", "", "path to a newline-separated file of peer ids/multiaddrs already addressed under the old mkBuiltinAddr6 fold; import them into --state without collision checks and exit")
+	flag.Parse()
+
+	family, err := addrmap.ParseFamily(*familyFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	m, err := addrmap.Open(*statePath, family)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	return r
+
+	if *migrateLegacy != "" {
+		if err := runMigrateLegacy(m, *migrateLegacy); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *reverse != "" {
+		if err := runReverse(m, *reverse, outputFormat(*format)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	arg := *peerFlag
+	if arg == "" && flag.NArg() > 0 {
+		arg = flag.Arg(0)
+	}
+
+	if arg == "-" {
+		if err := runBatch(m, os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if arg == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s [--format=plain|json|multiaddr] <peer id | multiaddr | ->\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	id, err := parsePeerArg(arg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ip, err := m.Allocate(id)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(render(id, ip, outputFormat(*format)))
 }
 
-func mkBuiltinAddr6(peer_id string) net.IP {
-	p, err := peer.Decode(peer_id)
+// parsePeerArg accepts a bare peer ID, a `/p2p/<id>` multiaddr, or an
+// encapsulated multiaddr like `/ip4/.../p2p/<id>` and returns the peer ID it
+// names. This mirrors how ipfs-cluster's Libp2pMultiaddrSplit pulls the
+// trailing /p2p component off a transport address.
+func parsePeerArg(arg string) (peer.ID, error) {
+	if !strings.HasPrefix(arg, "/") {
+		return peer.Decode(arg)
+	}
+
+	addr, err := ma.NewMultiaddr(arg)
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("parsing multiaddr %q: %w", arg, err)
 	}
-	builtinAddr := []byte("\xfd\x00hyprspace\x00\x00\x00\x00\x00")
-	for i, b := range []byte(p) {
-		builtinAddr[(i%4)+12] ^= b
+	_, id := ma.SplitLast(addr)
+	if id == nil || id.Protocol().Code != ma.P_P2P {
+		return "", fmt.Errorf("multiaddr %q has no trailing /p2p component", arg)
 	}
-	netId := MkNetID(p)
-	builtinAddr[12], builtinAddr[13], builtinAddr[14], builtinAddr[15] = netId[0], netId[1], netId[2], netId[3]
-	return net.IP(builtinAddr).To16()
+	return peer.Decode(id.Value())
 }
 
+// runBatch reads newline-separated peer IDs/multiaddrs from r and writes
+// `peerid<TAB>ip6` rows to w.
+func runBatch(m *addrmap.Map, r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
 
-func main() {
-	peerID := flag.String("peer", "", "peer id to use")
-	flag.Parse()
-	if *peerID == "" {
-		if flag.NArg() > 0 {
-			*peerID = flag.Arg(0)
-		} else {
-			fmt.Fprintf(os.Stderr, "Usage: %s <peer id>\n", os.Args[0])
-			os.Exit(1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		id, err := parsePeerArg(line)
+		if err != nil {
+			return err
+		}
+		ip, err := m.Allocate(id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, "%s\t%s\n", id, ip)
+	}
+	return scanner.Err()
+}
+
+// runMigrateLegacy reads newline-separated peer ids/multiaddrs from path and
+// imports them into m under the old mkBuiltinAddr6 fold, without rejecting
+// collisions, so an overlay already running on the deterministic-only
+// scheme can adopt collision detection for new peers without breaking the
+// addresses existing ones already have.
+func runMigrateLegacy(m *addrmap.Map, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("migrate-legacy: %w", err)
+	}
+	defer f.Close()
+
+	var ids []peer.ID
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
 		}
+		id, err := parsePeerArg(line)
+		if err != nil {
+			return fmt.Errorf("migrate-legacy: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("migrate-legacy: %w", err)
 	}
-	fmt.Print(mkBuiltinAddr6(*peerID))
-}
\ No newline at end of file
+
+	if err := m.MigrateLegacy(ids); err != nil {
+		return fmt.Errorf("migrate-legacy: %w", err)
+	}
+	fmt.Printf("migrated %d legacy peer(s) from %s\n", len(ids), path)
+	return nil
+}
+
+// runReverse looks up every locally-known peer ID whose derived address
+// matches ip and prints them in the requested format.
+func runReverse(m *addrmap.Map, ipStr string, format outputFormat) error {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return fmt.Errorf("invalid IPv6 address %q", ipStr)
+	}
+	for _, id := range m.Candidates(ip) {
+		fmt.Println(render(id, ip, format))
+	}
+	return nil
+}
+
+func render(id peer.ID, ip net.IP, format outputFormat) string {
+	switch format {
+	case formatJSON:
+		out, _ := json.Marshal(struct {
+			Peer string `json:"peer"`
+			IP   string `json:"ip"`
+		}{id.String(), ip.String()})
+		return string(out)
+	case formatMultiaddr:
+		if ip4 := ip.To4(); ip4 != nil {
+			return fmt.Sprintf("/ip4/%s/p2p/%s", ip4, id)
+		}
+		return fmt.Sprintf("/ip6/%s/p2p/%s", ip, id)
+	default:
+		return fmt.Sprintf("%s\t%s", id, ip)
+	}
+}
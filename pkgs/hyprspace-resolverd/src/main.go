@@ -0,0 +1,76 @@
+// Command hyprspace-resolverd serves the `hyprspace.` DNS zone over classic
+// DNS and mDNS, mapping each known peer's short ID to the ULA address
+// addrmap derives for it, so operators can `ssh abcd1234.hyprspace`
+// instead of looking up addresses by hand.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	pstoremem "github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	"github.com/miekg/dns"
+
+	"github.com/Qubasa/vpn-bench/pkgs/hyprspace-pre-generate/src/addrmap"
+)
+
+func main() {
+	dnsAddr := flag.String("dns", ":53", "address to serve classic DNS on")
+	statePath := flag.String("state", "hyprspace-addr.json", "path to the persistent peer<->address map")
+	familyFlag := flag.String("family", "ula6", "address family to serve: ula6 (IPv6 ULA) or cgnat (IPv4 100.64.0.0/10)")
+	ttl := flag.Duration("ttl", 5*time.Minute, "how long a resolved address is cached before re-checking the peerstore")
+	watchInterval := flag.Duration("watch-interval", 30*time.Second, "how often to reload the state file and scan the peerstore for new peers")
+	noMDNS := flag.Bool("no-mdns", false, "disable publishing peers over mDNS (.local)")
+	flag.Parse()
+
+	family, err := addrmap.ParseFamily(*familyFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	m, err := addrmap.Open(*statePath, family)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// The peerstore starts empty; resolver.knownPeers() folds in whatever it
+	// tracks with whatever addrmap's state file already has recorded, so a
+	// libp2p host that later attaches its own peerstore here still gets its
+	// peers' pubkeys used for full-entropy derivation via KeyBook.PubKey.
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	r := newResolver(ps, m, *ttl)
+
+	stop := make(chan struct{})
+	go r.watch(*watchInterval, stop)
+
+	if !*noMDNS {
+		if err := registerMDNS(r, stop); err != nil {
+			fmt.Fprintln(os.Stderr, "mdns:", err)
+		}
+	}
+
+	server := &dns.Server{Addr: *dnsAddr, Net: "udp", Handler: r}
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			fmt.Fprintln(os.Stderr, "dns server:", err)
+		}
+	}()
+	fmt.Printf("hyprspace-resolverd: serving %s over DNS on %s\n", zone, *dnsAddr)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	close(stop)
+	server.Shutdown()
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/miekg/dns"
+
+	"github.com/Qubasa/vpn-bench/pkgs/hyprspace-pre-generate/src/addrmap"
+)
+
+// zone is the DNS zone this resolver answers for, e.g. a lookup for
+// "abcd1234.hyprspace." resolves the peer whose ID's short form is
+// "abcd1234".
+const zone = "hyprspace."
+
+// cacheEntry memoizes a successful peer->address lookup, the same way
+// tendermint's p2p layer caches resolved socket addresses so a flaky
+// upstream lookup doesn't have to be repeated (or allowed to panic the
+// server) on every subsequent query.
+type cacheEntry struct {
+	ip       net.IP
+	cachedAt time.Time
+}
+
+// resolver watches a libp2p peerstore, derives each peer's ULA address with
+// addrmap, and serves that mapping over both classic DNS and mDNS.
+type resolver struct {
+	ps  peerstore.Peerstore
+	m   *addrmap.Map
+	ttl time.Duration
+
+	mu    sync.RWMutex
+	cache map[string]cacheEntry // short peer id -> resolved address
+
+	mdnsMu      sync.Mutex
+	mdnsStop    <-chan struct{}
+	mdnsServers map[peer.ID]*mdns.Server // peers already advertised over mDNS
+}
+
+func newResolver(ps peerstore.Peerstore, m *addrmap.Map, ttl time.Duration) *resolver {
+	return &resolver{
+		ps:          ps,
+		m:           m,
+		ttl:         ttl,
+		cache:       make(map[string]cacheEntry),
+		mdnsServers: make(map[peer.ID]*mdns.Server),
+	}
+}
+
+// allocate derives (and persists) p's address, preferring the full-entropy
+// derivation when the peerstore already knows p's public key. A peerstore's
+// KeyBook retains the real public key for peers it has shaken hands with
+// regardless of how their peer.ID was encoded, which is exactly the case
+// addrmap.DeriveAddr needs for RSA/secp256k1 peers that Allocate alone can't
+// recover a key for.
+func (r *resolver) allocate(p peer.ID) (net.IP, error) {
+	if pub := r.ps.PubKey(p); pub != nil {
+		return r.m.AllocatePubKey(p, pub)
+	}
+	return r.m.Allocate(p)
+}
+
+// knownPeers returns every peer this resolver can currently see: the ones
+// addrmap has already allocated an address for (which includes peers
+// registered by other processes sharing the same state file, such as the
+// hyprspace-addr CLI) plus whatever the live libp2p peerstore has addresses
+// for. Relying on the peerstore alone leaves the resolver empty until
+// something else populates it in-process; addrmap's state file is the
+// thing both tools already agree on.
+func (r *resolver) knownPeers() []peer.ID {
+	seen := make(map[peer.ID]struct{})
+	var peers []peer.ID
+	for _, p := range r.m.Peers() {
+		if _, ok := seen[p]; !ok {
+			seen[p] = struct{}{}
+			peers = append(peers, p)
+		}
+	}
+	for _, p := range r.ps.PeersWithAddrs() {
+		if _, ok := seen[p]; !ok {
+			seen[p] = struct{}{}
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// shortID is the label hyprspace peers are addressed under, e.g.
+// "abcd1234.hyprspace." for peer ID "Qm...abcd1234".
+func shortID(p peer.ID) string {
+	s := p.String()
+	if len(s) > 8 {
+		s = s[len(s)-8:]
+	}
+	return strings.ToLower(s)
+}
+
+// lookup resolves label (without the trailing zone) to an address, using
+// the memoized value if one is cached and still fresh. A missing or stale
+// entry is re-derived and cached again. If that fails, a previously cached
+// address is returned instead of an error; the stale entry is kept as it
+// is, so each later query for that label tries to re-derive it again.
+func (r *resolver) lookup(label string) (net.IP, bool) {
+	r.mu.RLock()
+	entry, ok := r.cache[label]
+	r.mu.RUnlock()
+	if ok && time.Since(entry.cachedAt) < r.ttl {
+		return entry.ip, true
+	}
+
+	for _, p := range r.knownPeers() {
+		if shortID(p) != label {
+			continue
+		}
+		ip, err := r.allocate(p)
+		if err != nil {
+			// Fall back to whatever we had cached rather than answering
+			// NXDOMAIN for a peer we already knew about.
+			if ok {
+				return entry.ip, true
+			}
+			return nil, false
+		}
+		r.mu.Lock()
+		r.cache[label] = cacheEntry{ip: ip, cachedAt: time.Now()}
+		r.mu.Unlock()
+		return ip, true
+	}
+
+	if ok {
+		return entry.ip, true
+	}
+	return nil, false
+}
+
+// watch reloads addrmap's state file and polls the peerstore every
+// interval, warming the cache for any peer it hasn't seen yet so the first
+// real query for a newly-joined peer doesn't have to pay the allocation
+// cost, and advertising any such peer over mDNS if registerMDNS has been
+// called. Reloading addrmap is what actually picks up new peers in
+// practice: it's the state file other hyprspace tools (e.g. the CLI) write
+// to.
+func (r *resolver) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := r.m.Reload(); err != nil {
+				continue
+			}
+			for _, p := range r.knownPeers() {
+				label := shortID(p)
+				r.mu.RLock()
+				_, known := r.cache[label]
+				r.mu.RUnlock()
+				if known {
+					continue
+				}
+				ip, err := r.allocate(p)
+				if err != nil {
+					continue
+				}
+				r.mu.Lock()
+				r.cache[label] = cacheEntry{ip: ip, cachedAt: time.Now()}
+				r.mu.Unlock()
+			}
+			if err := r.registerNewMDNSPeers(); err != nil {
+				fmt.Fprintln(os.Stderr, "mdns:", err)
+			}
+		}
+	}
+}
+
+// ServeDNS answers A/AAAA queries under zone and PTR queries for the ULA
+// range, recovering from any panic in the lookup path so a single bad query
+// can't take the server down.
+func (r *resolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			msg.SetRcode(req, dns.RcodeServerFailure)
+			w.WriteMsg(msg)
+		}
+	}()
+
+	for _, q := range req.Question {
+		switch q.Qtype {
+		case dns.TypeA:
+			label := strings.TrimSuffix(strings.ToLower(q.Name), "."+zone)
+			ip, ok := r.lookup(label)
+			if !ok {
+				continue
+			}
+			ip4 := ip.To4()
+			if ip4 == nil {
+				continue
+			}
+			msg.Answer = append(msg.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(r.ttl.Seconds())},
+				A:   ip4,
+			})
+		case dns.TypeAAAA:
+			label := strings.TrimSuffix(strings.ToLower(q.Name), "."+zone)
+			ip, ok := r.lookup(label)
+			if !ok || ip.To4() != nil {
+				continue
+			}
+			msg.Answer = append(msg.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: uint32(r.ttl.Seconds())},
+				AAAA: ip,
+			})
+		case dns.TypePTR:
+			name, ok := r.reverseLookup(q.Name)
+			if !ok {
+				continue
+			}
+			msg.Answer = append(msg.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: uint32(r.ttl.Seconds())},
+				Ptr: name,
+			})
+		}
+	}
+
+	if len(msg.Answer) == 0 {
+		msg.SetRcode(req, dns.RcodeNameError)
+	}
+	w.WriteMsg(msg)
+}
+
+// reverseLookup answers a PTR query (e.g. "...ip6.arpa.") by resolving the
+// address back to a peer via addrmap and returning its hyprspace name.
+func (r *resolver) reverseLookup(ptrName string) (string, bool) {
+	arpa := strings.TrimSuffix(ptrName, ".")
+	id, err := addrPTRToPeer(r.m, arpa)
+	if err != nil {
+		return "", false
+	}
+	return shortID(id) + "." + zone, true
+}
+
+func addrPTRToPeer(m *addrmap.Map, arpa string) (peer.ID, error) {
+	ip, err := parsePTRName(arpa)
+	if err != nil {
+		return "", fmt.Errorf("resolverd: parsing PTR name %q: %w", arpa, err)
+	}
+	return m.Resolve(ip)
+}
+
+// parsePTRName turns a PTR query name (e.g. "...ip6.arpa" or
+// "...in-addr.arpa") back into the net.IP it names. dns.ReverseAddr does the
+// opposite conversion (IP -> arpa name); there's no inverse in the dns
+// package, so this walks the arpa labels by hand.
+func parsePTRName(name string) (net.IP, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	switch {
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(labels) != 32 {
+			return nil, fmt.Errorf("expected 32 nibble labels, got %d", len(labels))
+		}
+		nibbles := make([]byte, 32)
+		for i, l := range labels {
+			if len(l) != 1 {
+				return nil, fmt.Errorf("invalid nibble label %q", l)
+			}
+			// ip6.arpa labels are least-significant nibble first.
+			nibbles[31-i] = l[0]
+		}
+		raw, err := hex.DecodeString(string(nibbles))
+		if err != nil {
+			return nil, fmt.Errorf("decoding nibbles: %w", err)
+		}
+		return net.IP(raw), nil
+
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return nil, fmt.Errorf("expected 4 octet labels, got %d", len(labels))
+		}
+		rev := make([]string, 4)
+		for i, l := range labels {
+			rev[3-i] = l
+		}
+		ip := net.ParseIP(strings.Join(rev, "."))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid octets in %q", name)
+		}
+		return ip, nil
+
+	default:
+		return nil, fmt.Errorf("not an ip6.arpa or in-addr.arpa name")
+	}
+}
+
+// registerMDNS advertises every currently-known peer under <shortid>.local
+// so operators can `ssh abcd1234.local` without editing hosts files, and
+// arms r to keep doing so for peers watch discovers later rather than
+// taking a single static snapshot at startup.
+func registerMDNS(r *resolver, stop <-chan struct{}) error {
+	r.mdnsMu.Lock()
+	r.mdnsStop = stop
+	r.mdnsMu.Unlock()
+	return r.registerNewMDNSPeers()
+}
+
+// registerNewMDNSPeers starts an mDNS responder for every known peer that
+// doesn't already have one. It's safe to call repeatedly (e.g. from watch)
+// since already-registered peers are skipped.
+func (r *resolver) registerNewMDNSPeers() error {
+	r.mdnsMu.Lock()
+	defer r.mdnsMu.Unlock()
+
+	stop := r.mdnsStop
+	if stop == nil {
+		return nil
+	}
+
+	for _, p := range r.knownPeers() {
+		if _, ok := r.mdnsServers[p]; ok {
+			continue
+		}
+		ip, err := r.allocate(p)
+		if err != nil {
+			continue
+		}
+		service, err := mdns.NewMDNSService(shortID(p), "_hyprspace._tcp", "", "", 0, []net.IP{ip}, nil)
+		if err != nil {
+			return fmt.Errorf("resolverd: building mdns service for %s: %w", p, err)
+		}
+		server, err := mdns.NewServer(&mdns.Config{Zone: service})
+		if err != nil {
+			return fmt.Errorf("resolverd: starting mdns server for %s: %w", p, err)
+		}
+		r.mdnsServers[p] = server
+		go func() {
+			<-stop
+			server.Shutdown()
+		}()
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	pstoremem "github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	"github.com/miekg/dns"
+
+	"github.com/Qubasa/vpn-bench/pkgs/hyprspace-pre-generate/src/addrmap"
+)
+
+func TestParsePTRNameIP6Arpa(t *testing.T) {
+	want := net.ParseIP("fd00:6879:7072:7300::1234")
+	arpa := dnsReverseName(t, want)
+
+	got, err := parsePTRName(arpa)
+	if err != nil {
+		t.Fatalf("parsePTRName(%q): %v", arpa, err)
+	}
+	if !got.Equal(want) {
+		t.Errorf("parsePTRName(%q) = %s, want %s", arpa, got, want)
+	}
+}
+
+func TestParsePTRNameInAddrArpa(t *testing.T) {
+	want := net.ParseIP("100.64.1.2")
+	arpa := dnsReverseName(t, want)
+
+	got, err := parsePTRName(arpa)
+	if err != nil {
+		t.Fatalf("parsePTRName(%q): %v", arpa, err)
+	}
+	if !got.Equal(want) {
+		t.Errorf("parsePTRName(%q) = %s, want %s", arpa, got, want)
+	}
+}
+
+func TestParsePTRNameMalformed(t *testing.T) {
+	cases := []string{
+		"",
+		"not-a-reverse-name",
+		"1.2.3.in-addr.arpa", // too few octet labels
+		"g.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa", // invalid nibble
+	}
+	for _, arpa := range cases {
+		if _, err := parsePTRName(arpa); err == nil {
+			t.Errorf("parsePTRName(%q) should have failed", arpa)
+		}
+	}
+}
+
+func TestShortID(t *testing.T) {
+	id := genResolverPeerID(t)
+	short := shortID(id)
+	if len(short) != 8 {
+		t.Errorf("shortID(%s) = %q, want 8 characters", id, short)
+	}
+	full := id.String()
+	if want := strings.ToLower(full[len(full)-8:]); short != want {
+		t.Errorf("shortID(%s) = %q, want %q", id, short, want)
+	}
+}
+
+func TestLookupCachesUntilTTLExpires(t *testing.T) {
+	m, err := addrmap.Open(filepath.Join(t.TempDir(), "state.json"), addrmap.FamilyIPv6ULA)
+	if err != nil {
+		t.Fatalf("addrmap.Open: %v", err)
+	}
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatalf("pstoremem.NewPeerstore: %v", err)
+	}
+	r := newResolver(ps, m, time.Hour)
+
+	p := genResolverPeerID(t)
+	if _, err := m.Allocate(p); err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+
+	ip, ok := r.lookup(shortID(p))
+	if !ok {
+		t.Fatalf("lookup(%s) = not found, want an address", shortID(p))
+	}
+
+	// Force the cache entry to look stale; lookup should then re-derive the
+	// address from addrmap, which hands back the address it already
+	// allocated for p.
+	r.mu.Lock()
+	entry, cached := r.cache[shortID(p)]
+	if !cached {
+		r.mu.Unlock()
+		t.Fatalf("lookup(%s) did not cache the resolved address", shortID(p))
+	}
+	entry.cachedAt = time.Now().Add(-2 * r.ttl)
+	r.cache[shortID(p)] = entry
+	r.mu.Unlock()
+
+	got, ok := r.lookup(shortID(p))
+	if !ok {
+		t.Fatalf("lookup(%s) after expiry = not found, want the re-derived address", shortID(p))
+	}
+	if !got.Equal(ip) {
+		t.Errorf("lookup(%s) after expiry = %s, want %s", shortID(p), got, ip)
+	}
+}
+
+func TestLookupUnknownPeer(t *testing.T) {
+	m, err := addrmap.Open(filepath.Join(t.TempDir(), "state.json"), addrmap.FamilyIPv6ULA)
+	if err != nil {
+		t.Fatalf("addrmap.Open: %v", err)
+	}
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatalf("pstoremem.NewPeerstore: %v", err)
+	}
+	r := newResolver(ps, m, time.Hour)
+
+	if _, ok := r.lookup("deadbeef"); ok {
+		t.Error("lookup for an unknown label should report not found")
+	}
+}
+
+func genResolverPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating ed25519 key: %v", err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatalf("peer.IDFromPublicKey: %v", err)
+	}
+	return id
+}
+
+// dnsReverseName builds the arpa name a real DNS client would query for ip,
+// using the dns package's own IP->arpa conversion so the round trip
+// exercises parsePTRName's decoding against an independent implementation.
+func dnsReverseName(t *testing.T, ip net.IP) string {
+	t.Helper()
+	name, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		t.Fatalf("dns.ReverseAddr(%s): %v", ip, err)
+	}
+	return strings.TrimSuffix(name, ".")
+}